@@ -0,0 +1,64 @@
+// Copyright 2024 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// CacheConfig contains the configuration values for the trie database and
+// state snapshot resident in a blockchain, plus tuning knobs for auxiliary
+// subsystems that ride along with block processing.
+//
+// NOTE: this file only carries the field and the prefetch call site
+// (prefetchBlock, below) that the state prefetcher work added.
+// The rest of CacheConfig and the BlockChain type it configures live outside
+// this change and are intentionally left untouched here.
+type CacheConfig struct {
+	// PrefetchWorkers is the size of the worker pool statePrefetcher.Prefetch
+	// uses to warm state in parallel for blocks at or above
+	// prefetchTxThreshold. Zero (the default) picks runtime.GOMAXPROCS(0)/2
+	// at prefetch time, so most deployments never need to set this.
+	PrefetchWorkers int
+}
+
+// prefetchBlock launches the throwaway-statedb prefetch goroutine that
+// insertChain starts for the next block while the current one is still being
+// validated. It returns the interrupt channel that signals an early abort;
+// the caller owns this channel and is the only one that may close it, e.g.
+// once it decides the prefetch has gone stale. The goroutine itself never
+// closes it -- it only ever reads from it -- so a caller-initiated close can
+// never race a goroutine-initiated one.
+//
+// NOTE: this is only the prefetch call-site wiring insertChain is supposed to
+// use; the rest of insertChain's block-processing pipeline lives outside this
+// change and is intentionally not reproduced here.
+func (bc *BlockChain) prefetchBlock(block *types.Block, throwaway *state.StateDB) chan struct{} {
+	interrupt := make(chan struct{})
+	go func() {
+		if err := bc.prefetcher.Prefetch(block, throwaway, bc.vmConfig, interrupt); err != nil {
+			// Prefetch failures are routine during reorgs and aborted
+			// fetches -- the real processor will redo the work and
+			// surface any genuine error itself -- so this is a debug
+			// log, not a warning.
+			log.Debug("Block state prefetch failed", "number", block.NumberU64(), "hash", block.Hash(), "err", err)
+		}
+	}()
+	return interrupt
+}
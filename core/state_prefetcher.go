@@ -17,16 +17,55 @@
 package core
 
 import (
-	"github.com/ethereum/go-ethereum/consensus/misc"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
 	"sync/atomic"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/misc"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
 )
 
+// prefetchTxThreshold is the minimum number of transactions a block must carry
+// before the parallel worker pool pays for itself. Below it, the goroutine
+// setup and per-worker statedb.Copy dominate whatever disk latency prefetching
+// would otherwise hide, so Prefetch falls back to the plain serial loop.
+const prefetchTxThreshold = 100
+
+// Prefetcher is implemented by statePrefetcher. Prefetch returns an error
+// identifying the exact transaction that failed, so BlockChain's insertChain
+// goroutine can log it at debug level -- prefetch failures are routine during
+// reorgs -- while tests can still assert on them directly.
+type Prefetcher interface {
+	Prefetch(block *types.Block, statedb *state.StateDB, cfg vm.Config, interrupt <-chan struct{}) error
+}
+
+// PrefetchError reports a failure encountered while pre-warming state for a
+// block, identifying the exact transaction that triggered it.
+type PrefetchError struct {
+	BlockNumber *big.Int
+	BlockHash   common.Hash
+	TxIndex     int
+	TxHash      common.Hash
+	Err         error
+}
+
+func (e *PrefetchError) Error() string {
+	return fmt.Sprintf("prefetch: tx %d (%s) in block %d (%s): %v", e.TxIndex, e.TxHash, e.BlockNumber, e.BlockHash, e.Err)
+}
+
+func (e *PrefetchError) Unwrap() error { return e.Err }
+
 // statePrefetcher is a basic Prefetcher, which blindly executes a block on top
 // of an arbitrary state with the goal of prefetching potentially useful state
 // data from disk before the main block processor start executing.
@@ -36,6 +75,8 @@ type statePrefetcher struct {
 	engine consensus.Engine    // Consensus engine used for block rewards
 }
 
+var _ Prefetcher = (*statePrefetcher)(nil)
+
 // newStatePrefetcher initialises a new statePrefetcher.
 func newStatePrefetcher(config *params.ChainConfig, bc *BlockChain, engine consensus.Engine) *statePrefetcher {
 	return &statePrefetcher{
@@ -45,91 +86,337 @@ func newStatePrefetcher(config *params.ChainConfig, bc *BlockChain, engine conse
 	}
 }
 
+// manifestDir returns the directory prefetch manifests for this chain are
+// written to, one file per block number. It's namespaced by chain id, not
+// just block number, so two chain instances on the same host (e.g. a
+// mainnet and a testnet node, or two nodes mid resync) never collide on the
+// same manifest path for the same block number.
+func (p *statePrefetcher) manifestDir() string {
+	return filepath.Join(os.TempDir(), "geth-prefetch-manifests", strconv.FormatUint(p.config.ChainID.Uint64(), 10))
+}
+
+// newManifestWriter returns a fresh writer for a single block's manifest.
+func (p *statePrefetcher) newManifestWriter() *types.TxManifestWriter {
+	return types.NewTxManifestWriter(p.manifestDir(), p.config.ChainID.Uint64())
+}
+
+// txPrefetchResult is funneled from a worker to the manifest-writing goroutine
+// once it has finished (or failed to) applying a single transaction. Workers
+// complete out of order; the index lets the drainer replay them canonically.
+type txPrefetchResult struct {
+	index int
+	hash  common.Hash
+	err   error
+}
+
+// watchInterrupt spawns a goroutine that cancels vmenv as soon as interrupt
+// fires, so a stale prefetch aborts the transaction it's in the middle of
+// instead of only noticing at the next tx boundary. The caller must invoke
+// the returned stop func once vmenv is no longer in use, so the goroutine
+// can exit.
+func watchInterrupt(interrupt <-chan struct{}, vmenv *vm.EVM) (stop func()) {
+	if interrupt == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupt:
+			vmenv.Cancel()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
 // Prefetch processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb, but any changes are discarded. The
 // only goal is to pre-cache transaction signatures and state trie nodes.
-func (p *statePrefetcher) Prefetch(block *types.Block, statedb *state.StateDB, cfg vm.Config, interrupt *atomic.Bool) {
-	//var (
-	//	header       = block.Header()
-	//	gaspool      = new(GasPool).AddGas(block.GasLimit())
-	//	blockContext = NewEVMBlockContext(header, p.bc, nil)
-	//	evm          = vm.NewEVM(blockContext, vm.TxContext{}, statedb, p.config, cfg)
-	//	signer       = types.MakeSigner(p.config, header.Number, header.Time)
-	//)
-	//// Iterate over and process the individual transactions
-	//byzantium := p.config.IsByzantium(block.Number())
-	//if len(block.Transactions()) > 0 {
-	//	types.InitTxFile(header.Number)
-	//}
-	//for i, tx := range block.Transactions() {
-	//	// If block precaching was interrupted, abort
-	//	if interrupt != nil && interrupt.Load() {
-	//		return
-	//	}
-	//	// Convert the transaction into an executable message and pre-cache its sender
-	//	msg, err := TransactionToMessage(tx, signer, header.BaseFee)
-	//	if err != nil {
-	//		return // Also invalid block, bail out
-	//	}
-	//	statedb.SetTxContext(tx.Hash(), i)
-	//	types.WriteHash(header.Number, tx.Hash())
-	//	if err := precacheTransaction(msg, p.config, gaspool, statedb, header, evm); err != nil {
-	//		log.Error("precacheTransaction", "blockNumber", block.Number(), "hash", tx.Hash(), "err", err)
-	//		types.DelTxFile(header.Number)
-	//		return // Ugh, something went horribly wrong, bail out
-	//	}
-	//	types.WriteHash(header.Number, tx.Hash())
-	//	// If we're pre-byzantium, pre-load trie nodes for the intermediate root
-	//	if !byzantium {
-	//		statedb.IntermediateRoot(true)
-	//	}
-	//}
-	//if len(block.Transactions()) > 0 {
-	//	types.ReNameTxFile(header.Number)
-	//}
-	//// If were post-byzantium, pre-load trie nodes for the final root hash
-	//if byzantium {
-	//	statedb.IntermediateRoot(true)
-	//}
+func (p *statePrefetcher) Prefetch(block *types.Block, statedb *state.StateDB, cfg vm.Config, interrupt <-chan struct{}) error {
+	header := block.Header()
+	// Mutate the block and state according to any hard-fork specs
+	if p.config.DAOForkSupport && p.config.DAOForkBlock != nil && p.config.DAOForkBlock.Cmp(block.Number()) == 0 {
+		misc.ApplyDAOHardFork(statedb)
+	}
+	txs := block.Transactions()
+	if len(txs) == 0 {
+		return nil
+	}
+	signer := types.MakeSigner(p.config, header.Number, header.Time)
+	byzantium := p.config.IsByzantium(block.Number())
+
+	if len(txs) < prefetchTxThreshold {
+		return p.prefetchSerial(block, statedb, cfg, signer, byzantium, interrupt)
+	}
+	return p.prefetchParallel(block, statedb, cfg, signer, byzantium, interrupt)
+}
 
+// prefetchSerial is the original single-goroutine prefetch loop, kept around
+// for blocks too small for worker coordination to be worth it.
+func (p *statePrefetcher) prefetchSerial(block *types.Block, statedb *state.StateDB, cfg vm.Config, signer types.Signer, byzantium bool, interrupt <-chan struct{}) error {
 	var (
 		usedGas     = new(uint64)
 		header      = block.Header()
 		blockHash   = block.Hash()
 		blockNumber = block.Number()
 		gp          = new(GasPool).AddGas(block.GasLimit())
+		context     = NewEVMBlockContext(header, p.bc, nil)
+		vmenv       = vm.NewEVM(context, vm.TxContext{}, statedb, p.config, cfg)
 	)
-	// Mutate the block and state according to any hard-fork specs
-	if p.config.DAOForkSupport && p.config.DAOForkBlock != nil && p.config.DAOForkBlock.Cmp(block.Number()) == 0 {
-		misc.ApplyDAOHardFork(statedb)
+	manifest := p.newManifestWriter()
+	manifest.Begin(header.Number.Uint64(), blockHash)
+	stop := watchInterrupt(interrupt, vmenv)
+	defer stop()
+	for i, tx := range block.Transactions() {
+		// If block precaching was interrupted, abort
+		select {
+		case <-interrupt:
+			return nil
+		default:
+		}
+		statedb.SetTxContext(tx.Hash(), i)
+		if useAccessListFastPath(tx) {
+			prefetchAccessList(statedb, tx)
+			manifest.Append(uint32(i), tx.Hash())
+			if !byzantium {
+				statedb.IntermediateRoot(true)
+			}
+			continue
+		}
+		msg, err := TransactionToMessage(tx, signer, header.BaseFee)
+		if err != nil {
+			manifest.Abort()
+			return &PrefetchError{
+				BlockNumber: blockNumber, BlockHash: blockHash, TxIndex: i, TxHash: tx.Hash(),
+				Err: err,
+			}
+		}
+		if _, err := applyTransaction(msg, p.config, gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv); err != nil {
+			// A watcher-triggered Cancel mid-execution surfaces here as an
+			// ApplyMessage error too; treat it as the interrupt it is,
+			// not as a failed transaction.
+			if vmenv.Cancelled() {
+				return nil
+			}
+			manifest.Abort()
+			return &PrefetchError{
+				BlockNumber: blockNumber, BlockHash: blockHash, TxIndex: i, TxHash: tx.Hash(),
+				Err: err,
+			}
+		}
+		if vmenv.Cancelled() {
+			return nil
+		}
+		manifest.Append(uint32(i), tx.Hash())
+		// If we're pre-byzantium, pre-load trie nodes for the intermediate root
+		if !byzantium {
+			statedb.IntermediateRoot(true)
+		}
+	}
+	if err := manifest.Commit(); err != nil {
+		log.Error("Failed to commit prefetch manifest", "block", header.Number, "err", err)
+	}
+	// If we're post-byzantium, pre-load trie nodes for the final root hash
+	if byzantium {
+		statedb.IntermediateRoot(true)
+	}
+	return nil
+}
+
+// useAccessListFastPath reports whether a transaction carries a non-empty
+// EIP-2930 access list, letting Prefetch warm state directly from it instead
+// of paying for a full EVM execution.
+func useAccessListFastPath(tx *types.Transaction) bool {
+	switch tx.Type() {
+	case types.AccessListTxType, types.DynamicFeeTxType:
+		return len(tx.AccessList()) > 0
+	default:
+		return false
+	}
+}
+
+// prefetchAccessList walks a typed transaction's declared access list,
+// touching every address and storage slot it names so the underlying trie
+// nodes land in the statedb's cache without executing the transaction.
+func prefetchAccessList(statedb *state.StateDB, tx *types.Transaction) {
+	for _, entry := range tx.AccessList() {
+		statedb.GetCode(entry.Address)
+		for _, key := range entry.StorageKeys {
+			statedb.GetState(entry.Address, key)
+		}
+	}
+}
+
+// prefetchParallel fans the block's transactions out across a worker pool.
+// Workers do not own a fixed slice of the block; instead they all pull the
+// next unassigned index off a shared atomic counter, so a worker that lands
+// on a string of cheap txs automatically steals work from one stuck on an
+// expensive one, rather than idling while pre-partitioned slices finish
+// unevenly.
+func (p *statePrefetcher) prefetchParallel(block *types.Block, statedb *state.StateDB, cfg vm.Config, signer types.Signer, byzantium bool, interrupt <-chan struct{}) error {
+	var (
+		header      = block.Header()
+		txs         = block.Transactions()
+		blockHash   = block.Hash()
+		blockNumber = block.Number()
+	)
+	manifest := p.newManifestWriter()
+	manifest.Begin(header.Number.Uint64(), blockHash)
+
+	workers := p.bc.cacheConfig.PrefetchWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0) / 2
 	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(txs) {
+		workers = len(txs)
+	}
+
 	var (
-		context = NewEVMBlockContext(header, p.bc, nil)
-		vmenv   = vm.NewEVM(context, vm.TxContext{}, statedb, p.config, cfg)
-		signer  = types.MakeSigner(p.config, header.Number, header.Time)
+		next      atomic.Int64
+		results   = make(chan txPrefetchResult, len(txs))
+		wg        sync.WaitGroup
+		abort     = make(chan struct{})
+		abortOnce sync.Once
 	)
-	if len(block.Transactions()) > 0 {
-		types.InitTxFile(header.Number)
+	// abortPool is called by a worker that hits a real tx failure, so its
+	// siblings stop pulling fresh work instead of executing the rest of a
+	// block that's going to be rejected anyway.
+	abortPool := func() { abortOnce.Do(func() { close(abort) }) }
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Each worker only pays for its own statedb.Copy once it is
+			// actually handed a tx, so a worker that never gets scheduled
+			// (its siblings drained the counter first) doesn't copy state
+			// for nothing.
+			var (
+				env   *state.StateDB
+				gp    *GasPool
+				vmenv *vm.EVM
+			)
+			for {
+				select {
+				case <-interrupt:
+					return
+				case <-abort:
+					return
+				default:
+				}
+				i := int(next.Add(1)) - 1
+				if i >= len(txs) {
+					// Post-byzantium, warm the final root on this worker's
+					// own copy before it's discarded: env shares its
+					// underlying trie database with statedb, so the trie
+					// nodes touched here land in the same cache the real
+					// processor will read from, even though env itself
+					// never gets merged back into statedb.
+					if byzantium && env != nil {
+						env.IntermediateRoot(true)
+					}
+					return
+				}
+				if env == nil {
+					env = statedb.Copy()
+				}
+				tx := txs[i]
+				env.SetTxContext(tx.Hash(), i)
+				if useAccessListFastPath(tx) {
+					prefetchAccessList(env, tx)
+					if !byzantium {
+						env.IntermediateRoot(true)
+					}
+					results <- txPrefetchResult{index: i, hash: tx.Hash()}
+					continue
+				}
+				if vmenv == nil {
+					gp = new(GasPool).AddGas(block.GasLimit())
+					context := NewEVMBlockContext(header, p.bc, nil)
+					vmenv = vm.NewEVM(context, vm.TxContext{}, env, p.config, cfg)
+					stop := watchInterrupt(interrupt, vmenv)
+					defer stop()
+				}
+				msg, err := TransactionToMessage(tx, signer, header.BaseFee)
+				if err != nil {
+					results <- txPrefetchResult{index: i, hash: tx.Hash(), err: err}
+					abortPool()
+					return
+				}
+				_, err = applyTransaction(msg, p.config, gp, env, blockNumber, blockHash, tx, new(uint64), vmenv)
+				if err != nil {
+					// A watcher-triggered Cancel mid-execution surfaces here
+					// as an ApplyMessage error too; treat it as the
+					// interrupt it is, not as a failed transaction. Mirror
+					// prefetchSerial otherwise: any real tx failure means an
+					// invalid block, so this worker bails out -- and tells
+					// the rest of the pool to do the same -- instead of
+					// burning CPU on the rest of the block.
+					if vmenv.Cancelled() {
+						return
+					}
+					results <- txPrefetchResult{index: i, hash: tx.Hash(), err: err}
+					abortPool()
+					return
+				}
+				if vmenv.Cancelled() {
+					return
+				}
+				if !byzantium {
+					env.IntermediateRoot(true)
+				}
+				results <- txPrefetchResult{index: i, hash: tx.Hash(), err: err}
+			}
+		}()
 	}
-	// Iterate over and process the individual transactions
-	for i, tx := range block.Transactions() {
-		msg, err := TransactionToMessage(tx, signer, header.BaseFee)
-		if err != nil {
-			types.DelTxFile(header.Number)
-			return
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Drain completion records in canonical tx order so the on-disk manifest
+	// comes out identical to what the serial path would have produced, even
+	// though workers finish out of order.
+	var (
+		pending  = make(map[int]txPrefetchResult, len(txs))
+		next_    int
+		firstErr *PrefetchError
+	)
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = &PrefetchError{
+					BlockNumber: blockNumber, BlockHash: blockHash,
+					TxIndex: res.index, TxHash: res.hash, Err: res.err,
+				}
+			}
+			continue
 		}
-		statedb.SetTxContext(tx.Hash(), i)
-		types.WriteHash(header.Number, tx.Hash())
-		_, err = applyTransaction(msg, p.config, gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv)
-		if err != nil {
-			types.DelTxFile(header.Number)
-			return
+		pending[res.index] = res
+		for {
+			r, ok := pending[next_]
+			if !ok {
+				break
+			}
+			manifest.Append(uint32(r.index), r.hash)
+			delete(pending, next_)
+			next_++
 		}
-		types.WriteHash(header.Number, tx.Hash())
 	}
-	if len(block.Transactions()) > 0 {
-		types.ReNameTxFile(header.Number)
+	if firstErr != nil || next_ != len(txs) {
+		manifest.Abort()
+		return firstErr
+	}
+	if err := manifest.Commit(); err != nil {
+		log.Error("Failed to commit prefetch manifest", "block", header.Number, "err", err)
 	}
+	// Post-byzantium, each worker already warmed the final root on its own
+	// statedb copy just before exiting, above; there is no single merged
+	// statedb here to call IntermediateRoot on again.
+	return nil
 }
 
 // precacheTransaction attempts to apply a transaction to the given state database
@@ -0,0 +1,353 @@
+// Copyright 2024 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// countingDatabase wraps an ethdb.Database and counts Get calls, so a test
+// can prove Prefetch actually caused trie-node reads against the underlying
+// store rather than merely observing a non-empty root hash, which a fresh
+// statedb would produce anyway once genesis funds an account.
+type countingDatabase struct {
+	ethdb.Database
+	reads atomic.Int64
+}
+
+func (c *countingDatabase) Get(key []byte) ([]byte, error) {
+	c.reads.Add(1)
+	return c.Database.Get(key)
+}
+
+// newAccessListTx builds a signed EIP-2930 transaction whose access list
+// touches n distinct (address, slot) pairs, so prefetching it via the fast
+// path and via full execution can be compared on equal footing.
+func newAccessListTx(b *testing.B, key *ecdsa.PrivateKey, nonce uint64, n int) *types.Transaction {
+	b.Helper()
+	list := make(types.AccessList, n)
+	for i := 0; i < n; i++ {
+		list[i] = types.AccessTuple{
+			Address:     common.BigToAddress(big.NewInt(int64(i + 1))),
+			StorageKeys: []common.Hash{common.BigToHash(big.NewInt(int64(i + 1)))},
+		}
+	}
+	tx, err := types.SignNewTx(key, types.LatestSignerForChainID(params.TestChainConfig.ChainID), &types.AccessListTx{
+		ChainID:    params.TestChainConfig.ChainID,
+		Nonce:      nonce,
+		GasPrice:   big.NewInt(1_000_000_000),
+		Gas:        21000,
+		To:         &common.Address{},
+		AccessList: list,
+	})
+	if err != nil {
+		b.Fatalf("sign access list tx: %v", err)
+	}
+	return tx
+}
+
+// BenchmarkPrefetchAccessList compares the EIP-2930 access-list fast path
+// against the full EVM execution path it replaces for typed transactions
+// that carry a non-empty access list.
+func BenchmarkPrefetchAccessList(b *testing.B) {
+	key, _ := crypto.GenerateKey()
+	header := &types.Header{Number: big.NewInt(1), GasLimit: 8_000_000}
+
+	const txsPerBlock = 200
+	txs := make([]*types.Transaction, txsPerBlock)
+	for i := range txs {
+		txs[i] = newAccessListTx(b, key, uint64(i), 8)
+	}
+	signer := types.LatestSignerForChainID(params.TestChainConfig.ChainID)
+
+	b.Run("AccessListFastPath", func(b *testing.B) {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, tx := range txs {
+				prefetchAccessList(statedb, tx)
+			}
+		}
+	})
+
+	b.Run("FullExecution", func(b *testing.B) {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		blockCtx := vm.BlockContext{
+			CanTransfer: CanTransfer,
+			Transfer:    Transfer,
+			GetHash:     func(uint64) common.Hash { return common.Hash{} },
+			BlockNumber: header.Number,
+			GasLimit:    header.GasLimit,
+			Difficulty:  big.NewInt(0),
+		}
+		evm := vm.NewEVM(blockCtx, vm.TxContext{}, statedb, params.TestChainConfig, vm.Config{})
+		gp := new(GasPool).AddGas(header.GasLimit)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, tx := range txs {
+				msg, err := TransactionToMessage(tx, signer, header.BaseFee)
+				if err != nil {
+					b.Fatalf("tx to message: %v", err)
+				}
+				if err := precacheTransaction(msg, params.TestChainConfig, gp, statedb, header, evm); err != nil {
+					b.Fatalf("precache: %v", err)
+				}
+			}
+		}
+	})
+}
+
+// TestPrefetchHomesteadWarmsIntermediateRoot runs Prefetch on a pre-byzantium
+// block, where it computes the intermediate root after every transaction, and
+// checks that the run read trie nodes from the underlying database. The read
+// count does not tell per-transaction roots apart from a single final one.
+func TestPrefetchHomesteadWarmsIntermediateRoot(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1_000_000_000_000_000_000)
+		config  = *params.HomesteadChainConfig
+		gspec   = &Genesis{
+			Config: &config,
+			Alloc:  types.GenesisAlloc{address: {Balance: funds}},
+		}
+	)
+	counted := &countingDatabase{Database: rawdb.NewMemoryDatabase()}
+	genesis := gspec.MustCommit(counted)
+
+	engine := ethash.NewFaker()
+	bc, err := NewBlockChain(counted, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("create blockchain: %v", err)
+	}
+	defer bc.Stop()
+
+	signer := types.HomesteadSigner{}
+	blocks, _ := GenerateChain(&config, genesis, engine, counted, 1, func(i int, b *BlockGen) {
+		for n := 0; n < 5; n++ {
+			tx, err := types.SignTx(types.NewTransaction(uint64(n), common.Address{1}, big.NewInt(1000), params.TxGas, b.header.BaseFee, nil), signer, key)
+			if err != nil {
+				t.Fatalf("sign tx: %v", err)
+			}
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	statedb, err := state.New(genesis.Root(), state.NewDatabase(counted), nil)
+	if err != nil {
+		t.Fatalf("new statedb: %v", err)
+	}
+	prefetcher := newStatePrefetcher(&config, bc, engine)
+	before := counted.reads.Load()
+	if err := prefetcher.Prefetch(block, statedb, vm.Config{}, nil); err != nil {
+		t.Fatalf("prefetch: %v", err)
+	}
+	if after := counted.reads.Load(); after <= before {
+		t.Fatalf("expected prefetch to read trie nodes from the database, reads before=%d after=%d", before, after)
+	}
+}
+
+// TestPrefetchParallelWarmsTrieCache is the parallel-path counterpart of
+// TestPrefetchHomesteadWarmsIntermediateRoot: it generates enough
+// transactions to clear prefetchTxThreshold, so Prefetch actually dispatches
+// to prefetchParallel, and checks that the run, including the byzantium
+// final-root warming done on each worker's own statedb copy, read trie nodes
+// from the shared underlying database. The read count covers transaction
+// execution and root warming together.
+func TestPrefetchParallelWarmsTrieCache(t *testing.T) {
+	const txCount = 150 // comfortably over prefetchTxThreshold
+
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1_000_000_000_000_000_000)
+		config  = *params.TestChainConfig // byzantium (and later) active from genesis
+		gspec   = &Genesis{
+			Config: &config,
+			Alloc:  types.GenesisAlloc{address: {Balance: funds}},
+		}
+	)
+	counted := &countingDatabase{Database: rawdb.NewMemoryDatabase()}
+	genesis := gspec.MustCommit(counted)
+
+	engine := ethash.NewFaker()
+	bc, err := NewBlockChain(counted, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("create blockchain: %v", err)
+	}
+	defer bc.Stop()
+
+	signer := types.LatestSignerForChainID(config.ChainID)
+	blocks, _ := GenerateChain(&config, genesis, engine, counted, 1, func(i int, b *BlockGen) {
+		for n := 0; n < txCount; n++ {
+			tx, err := types.SignTx(types.NewTransaction(uint64(n), common.Address{1}, big.NewInt(1000), params.TxGas, b.header.BaseFee, nil), signer, key)
+			if err != nil {
+				t.Fatalf("sign tx: %v", err)
+			}
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	if len(block.Transactions()) < prefetchTxThreshold {
+		t.Fatalf("test block has %d txs, want at least prefetchTxThreshold=%d to exercise prefetchParallel", len(block.Transactions()), prefetchTxThreshold)
+	}
+
+	statedb, err := state.New(genesis.Root(), state.NewDatabase(counted), nil)
+	if err != nil {
+		t.Fatalf("new statedb: %v", err)
+	}
+	prefetcher := newStatePrefetcher(&config, bc, engine)
+	before := counted.reads.Load()
+	if err := prefetcher.Prefetch(block, statedb, vm.Config{}, nil); err != nil {
+		t.Fatalf("prefetch: %v", err)
+	}
+	if after := counted.reads.Load(); after <= before {
+		t.Fatalf("expected parallel prefetch to read trie nodes from the database, reads before=%d after=%d", before, after)
+	}
+}
+
+// TestPrefetchParallelHomesteadWarmsIntermediateRoot covers the pre-byzantium
+// branch of prefetchParallel specifically: with a homestead ChainConfig, each
+// worker calls env.IntermediateRoot(true) after every transaction (not just
+// once before discarding its copy, as TestPrefetchParallelWarmsTrieCache
+// exercises for byzantium+). Neither of the other two tests reaches this
+// branch -- TestPrefetchHomesteadWarmsIntermediateRoot is homestead but below
+// prefetchTxThreshold, so it never dispatches to prefetchParallel at all.
+func TestPrefetchParallelHomesteadWarmsIntermediateRoot(t *testing.T) {
+	const txCount = 150 // comfortably over prefetchTxThreshold
+
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1_000_000_000_000_000_000)
+		config  = *params.HomesteadChainConfig // pre-byzantium
+		gspec   = &Genesis{
+			Config: &config,
+			Alloc:  types.GenesisAlloc{address: {Balance: funds}},
+		}
+	)
+	counted := &countingDatabase{Database: rawdb.NewMemoryDatabase()}
+	genesis := gspec.MustCommit(counted)
+
+	engine := ethash.NewFaker()
+	bc, err := NewBlockChain(counted, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("create blockchain: %v", err)
+	}
+	defer bc.Stop()
+
+	signer := types.HomesteadSigner{}
+	blocks, _ := GenerateChain(&config, genesis, engine, counted, 1, func(i int, b *BlockGen) {
+		for n := 0; n < txCount; n++ {
+			tx, err := types.SignTx(types.NewTransaction(uint64(n), common.Address{1}, big.NewInt(1000), params.TxGas, b.header.BaseFee, nil), signer, key)
+			if err != nil {
+				t.Fatalf("sign tx: %v", err)
+			}
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	if len(block.Transactions()) < prefetchTxThreshold {
+		t.Fatalf("test block has %d txs, want at least prefetchTxThreshold=%d to exercise prefetchParallel", len(block.Transactions()), prefetchTxThreshold)
+	}
+	if config.IsByzantium(block.Number()) {
+		t.Fatalf("test config is byzantium at block %d, want pre-byzantium to cover the per-tx IntermediateRoot branch", block.Number())
+	}
+
+	statedb, err := state.New(genesis.Root(), state.NewDatabase(counted), nil)
+	if err != nil {
+		t.Fatalf("new statedb: %v", err)
+	}
+	prefetcher := newStatePrefetcher(&config, bc, engine)
+	before := counted.reads.Load()
+	if err := prefetcher.Prefetch(block, statedb, vm.Config{}, nil); err != nil {
+		t.Fatalf("prefetch: %v", err)
+	}
+	if after := counted.reads.Load(); after <= before {
+		t.Fatalf("expected parallel prefetch to read trie nodes from the database, reads before=%d after=%d", before, after)
+	}
+}
+
+// TestPrefetchReturnsPrefetchError verifies that a transaction with a bad
+// signature surfaces as a *PrefetchError identifying the offending tx, rather
+// than Prefetch silently giving up.
+func TestPrefetchReturnsPrefetchError(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1_000_000_000_000_000_000)
+		config  = *params.TestChainConfig
+		gspec   = &Genesis{
+			Config: &config,
+			Alloc:  types.GenesisAlloc{address: {Balance: funds}},
+		}
+	)
+	db := rawdb.NewMemoryDatabase()
+	genesis := gspec.MustCommit(db)
+
+	engine := ethash.NewFaker()
+	bc, err := NewBlockChain(db, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("create blockchain: %v", err)
+	}
+	defer bc.Stop()
+
+	// Sign with a throwaway key under a different chain ID so the signer
+	// rejects it with an invalid-signature error.
+	badSigner := types.NewEIP155Signer(big.NewInt(config.ChainID.Int64() + 1))
+	otherKey, _ := crypto.GenerateKey()
+	tx, err := types.SignTx(types.NewTransaction(0, common.Address{1}, big.NewInt(1000), params.TxGas, big.NewInt(1), nil), badSigner, otherKey)
+	if err != nil {
+		t.Fatalf("sign tx: %v", err)
+	}
+
+	blocks, _ := GenerateChain(&config, genesis, engine, db, 1, func(i int, b *BlockGen) {
+		b.AddTxWithChain(bc, tx)
+	})
+	block := blocks[0]
+
+	statedb, err := state.New(genesis.Root(), state.NewDatabase(db), nil)
+	if err != nil {
+		t.Fatalf("new statedb: %v", err)
+	}
+	prefetcher := newStatePrefetcher(&config, bc, engine)
+	err = prefetcher.Prefetch(block, statedb, vm.Config{}, nil)
+
+	var prefetchErr *PrefetchError
+	if !errors.As(err, &prefetchErr) {
+		t.Fatalf("expected a *PrefetchError, got %v (%T)", err, err)
+	}
+	if prefetchErr.TxHash != tx.Hash() {
+		t.Fatalf("expected PrefetchError for tx %s, got %s", tx.Hash(), prefetchErr.TxHash)
+	}
+}
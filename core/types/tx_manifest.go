@@ -0,0 +1,223 @@
+// Copyright 2024 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Manifest file layout:
+//
+//	magic       [4]byte  "TXMF"
+//	version     uint16
+//	chain id    uint64
+//	block number uint64
+//	block hash  [32]byte
+//	record count uint32
+//	records     (tx_index uint32, tx_hash [32]byte, status byte) * record count
+//	crc32c      uint32   (over every byte above)
+//
+// The trailing checksum is what lets a reader distinguish a file a crash cut
+// short from a genuinely valid one, instead of relying on a rename to signal
+// completion.
+const (
+	txManifestMagic   = "TXMF"
+	txManifestVersion = uint16(1)
+
+	txManifestHeaderSize = 4 + 2 + 8 + 8 + common.HashLength
+	txManifestRecordSize = 4 + common.HashLength + 1
+)
+
+var txManifestCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// TxManifestStatus records the outcome of a single manifested transaction.
+type TxManifestStatus byte
+
+const (
+	// TxManifestApplied marks a transaction that was successfully prefetched.
+	TxManifestApplied TxManifestStatus = iota
+)
+
+// TxManifestRecord is one (tx_index, tx_hash, status) entry in a manifest.
+type TxManifestRecord struct {
+	Index  uint32
+	Hash   common.Hash
+	Status TxManifestStatus
+}
+
+// TxManifestWriter builds a crash-safe, checksummed manifest of the
+// transactions a block's prefetch pass has warmed state for. It replaces the
+// old InitTxFile/WriteHash/ReNameTxFile/DelTxFile convention, where a reader
+// could only tell a torn write from a valid file by its name.
+//
+// Begin/Append never touch disk; Commit writes the whole payload to a temp
+// file and renames it into place only after the trailing checksum has been
+// flushed, so a crash mid-block leaves no file behind rather than a
+// partially written one.
+type TxManifestWriter struct {
+	dir         string
+	chainID     uint64
+	blockNumber uint64
+	blockHash   common.Hash
+	records     []TxManifestRecord
+	path        string
+}
+
+// NewTxManifestWriter creates a writer that stores committed manifests under
+// dir, one file per block number.
+func NewTxManifestWriter(dir string, chainID uint64) *TxManifestWriter {
+	return &TxManifestWriter{dir: dir, chainID: chainID}
+}
+
+// Begin starts a manifest for the given block, discarding any records left
+// over from a previous, uncommitted call.
+func (w *TxManifestWriter) Begin(blockNumber uint64, blockHash common.Hash) {
+	w.blockNumber = blockNumber
+	w.blockHash = blockHash
+	w.records = w.records[:0]
+	w.path = filepath.Join(w.dir, fmt.Sprintf("%d.txm", blockNumber))
+}
+
+// Append records that the transaction at position index, with the given
+// hash, was prefetched.
+func (w *TxManifestWriter) Append(index uint32, hash common.Hash) {
+	w.records = append(w.records, TxManifestRecord{Index: index, Hash: hash, Status: TxManifestApplied})
+}
+
+// Commit atomically writes the manifest to dir/<blockNumber>.txm.
+func (w *TxManifestWriter) Commit() error {
+	if err := os.MkdirAll(w.dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(w.dir, "txm-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	buf := bufio.NewWriter(tmp)
+	hasher := crc32.New(txManifestCRCTable)
+	mw := io.MultiWriter(buf, hasher)
+
+	var header [txManifestHeaderSize]byte
+	copy(header[0:4], txManifestMagic)
+	binary.BigEndian.PutUint16(header[4:6], txManifestVersion)
+	binary.BigEndian.PutUint64(header[6:14], w.chainID)
+	binary.BigEndian.PutUint64(header[14:22], w.blockNumber)
+	copy(header[22:22+common.HashLength], w.blockHash.Bytes())
+	if _, err := mw.Write(header[:]); err != nil {
+		return err
+	}
+
+	var countBuf [4]byte
+	binary.BigEndian.PutUint32(countBuf[:], uint32(len(w.records)))
+	if _, err := mw.Write(countBuf[:]); err != nil {
+		return err
+	}
+	for _, r := range w.records {
+		var rec [txManifestRecordSize]byte
+		binary.BigEndian.PutUint32(rec[0:4], r.Index)
+		copy(rec[4:4+common.HashLength], r.Hash.Bytes())
+		rec[4+common.HashLength] = byte(r.Status)
+		if _, err := mw.Write(rec[:]); err != nil {
+			return err
+		}
+	}
+	var sumBuf [4]byte
+	binary.BigEndian.PutUint32(sumBuf[:], hasher.Sum32())
+	if _, err := buf.Write(sumBuf[:]); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), w.path)
+}
+
+// Abort discards the in-progress manifest. Since Begin/Append never write
+// anything, there is no partial file on disk to clean up.
+func (w *TxManifestWriter) Abort() {
+	w.records = w.records[:0]
+}
+
+// TxManifestReader is a validated, in-memory view of a committed manifest.
+type TxManifestReader struct {
+	ChainID     uint64
+	BlockNumber uint64
+	BlockHash   common.Hash
+	Records     []TxManifestRecord
+}
+
+// OpenTxManifest reads and validates the manifest at path. A checksum
+// mismatch or a payload too short to contain a header and trailer is
+// reported as an error rather than silently treated as an empty manifest,
+// so a truncated write from a crash can never be mistaken for a valid one.
+func OpenTxManifest(path string) (*TxManifestReader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < txManifestHeaderSize+4+4 {
+		return nil, fmt.Errorf("tx manifest %s: truncated, only %d bytes", path, len(data))
+	}
+	payload, trailer := data[:len(data)-4], data[len(data)-4:]
+	want := binary.BigEndian.Uint32(trailer)
+	if got := crc32.Checksum(payload, txManifestCRCTable); got != want {
+		return nil, fmt.Errorf("tx manifest %s: checksum mismatch (want %x, got %x)", path, want, got)
+	}
+	if string(payload[0:4]) != txManifestMagic {
+		return nil, fmt.Errorf("tx manifest %s: bad magic %q", path, payload[0:4])
+	}
+	if version := binary.BigEndian.Uint16(payload[4:6]); version != txManifestVersion {
+		return nil, fmt.Errorf("tx manifest %s: unsupported version %d", path, version)
+	}
+	r := &TxManifestReader{
+		ChainID:     binary.BigEndian.Uint64(payload[6:14]),
+		BlockNumber: binary.BigEndian.Uint64(payload[14:22]),
+		BlockHash:   common.BytesToHash(payload[22 : 22+common.HashLength]),
+	}
+	rest := payload[txManifestHeaderSize:]
+	if len(rest) < 4 {
+		return nil, fmt.Errorf("tx manifest %s: truncated record count", path)
+	}
+	count := binary.BigEndian.Uint32(rest[0:4])
+	rest = rest[4:]
+	if uint64(len(rest)) != uint64(count)*txManifestRecordSize {
+		return nil, fmt.Errorf("tx manifest %s: truncated records, expected %d got %d bytes", path, count, len(rest))
+	}
+	r.Records = make([]TxManifestRecord, count)
+	for i := range r.Records {
+		rec := rest[i*txManifestRecordSize : (i+1)*txManifestRecordSize]
+		r.Records[i] = TxManifestRecord{
+			Index:  binary.BigEndian.Uint32(rec[0:4]),
+			Hash:   common.BytesToHash(rec[4 : 4+common.HashLength]),
+			Status: TxManifestStatus(rec[4+common.HashLength]),
+		}
+	}
+	return r, nil
+}
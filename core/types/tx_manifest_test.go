@@ -0,0 +1,81 @@
+// Copyright 2024 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestTxManifestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	w := NewTxManifestWriter(dir, 1)
+	w.Begin(42, common.HexToHash("0xaa"))
+	w.Append(0, common.HexToHash("0x01"))
+	w.Append(1, common.HexToHash("0x02"))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	r, err := OpenTxManifest(filepath.Join(dir, "42.txm"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if r.BlockNumber != 42 || r.BlockHash != common.HexToHash("0xaa") {
+		t.Fatalf("unexpected header: %+v", r)
+	}
+	if len(r.Records) != 2 || r.Records[1].Hash != common.HexToHash("0x02") {
+		t.Fatalf("unexpected records: %+v", r.Records)
+	}
+}
+
+func TestTxManifestRejectsTruncatedFile(t *testing.T) {
+	dir := t.TempDir()
+	w := NewTxManifestWriter(dir, 1)
+	w.Begin(7, common.HexToHash("0xbb"))
+	w.Append(0, common.HexToHash("0x01"))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	path := filepath.Join(dir, "7.txm")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-5], 0o644); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if _, err := OpenTxManifest(path); err == nil {
+		t.Fatal("expected truncated manifest to be rejected")
+	}
+}
+
+func TestTxManifestAbortLeavesNoFile(t *testing.T) {
+	dir := t.TempDir()
+	w := NewTxManifestWriter(dir, 1)
+	w.Begin(9, common.HexToHash("0xcc"))
+	w.Append(0, common.HexToHash("0x01"))
+	w.Abort()
+
+	if _, err := os.Stat(filepath.Join(dir, "9.txm")); !os.IsNotExist(err) {
+		t.Fatalf("expected no manifest file after Abort, stat err = %v", err)
+	}
+}